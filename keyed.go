@@ -0,0 +1,101 @@
+package refresh
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// keyedValue holds the cached value for a single key of a KeyedRefresher. It
+// is deliberately separate from value, since KeyedRefresher doesn't need the
+// context-cancellation bookkeeping a Refresher's value carries.
+type keyedValue struct {
+	val interface{}
+	err error
+
+	when         time.Time
+	refresh      sync.Once // used if !staleWhileRefresh || when.IsZero()
+	refreshStale uint32    // used if staleWhileRefresh && !when.IsZero()
+}
+
+// KeyedRefresher is an object that will perform an action at most once every
+// specified duration, for each of a set of distinct keys. It behaves like a
+// Refresher per key, backed by a single loader function.
+type KeyedRefresher struct {
+	vals sync.Map // string -> *keyedValue
+
+	maxAge    time.Duration
+	refreshFn func(key string) (interface{}, error)
+
+	staleWhileRefresh bool
+}
+
+// NewKeyed returns a KeyedRefresher that will call refreshFn at most once
+// every maxAge duration, per key. refreshFn will not be called for a given
+// key until Load is called with that key.
+//
+// refreshFn will be called in the same goroutine as Load.
+func NewKeyed(maxAge time.Duration, refreshFn func(key string) (interface{}, error)) *KeyedRefresher {
+	if maxAge <= 0 {
+		panic("refresh: maxAge must be positive duration")
+	}
+
+	return &KeyedRefresher{sync.Map{}, maxAge, refreshFn, false}
+}
+
+// SetStaleWhileRefresh controls the behaviour of Load when a key's value is
+// stale. When set to true, only one call to Load for a given key will block
+// while any others return stale data. When set to false, all calls to Load
+// will block and only ever return fresh data. It defaults to false.
+func (r *KeyedRefresher) SetStaleWhileRefresh(v bool) {
+	r.staleWhileRefresh = v
+}
+
+// Load returns a value for key that is at most maxAge old. Load will only
+// ever return an error that was returned from refreshFn.
+//
+// Concurrent calls to Load for the same key coalesce into a single call to
+// refreshFn; calls for distinct keys never block one another. The behaviour
+// of Load when a key's value is stale can be controlled by
+// SetStaleWhileRefresh.
+func (r *KeyedRefresher) Load(key string) (interface{}, error) {
+	val := r.loadOrCreate(key)
+	switch {
+	case val.when.IsZero(): // first Load for this key
+	case time.Since(val.when) <= r.maxAge:
+		return val.val, val.err
+	case r.staleWhileRefresh:
+		return r.loadStale(key, val)
+	}
+
+	return r.loadFresh(key, val)
+}
+
+func (r *KeyedRefresher) loadOrCreate(key string) *keyedValue {
+	v, ok := r.vals.Load(key)
+	if !ok {
+		v, _ = r.vals.LoadOrStore(key, new(keyedValue))
+	}
+
+	return v.(*keyedValue)
+}
+
+func (r *KeyedRefresher) loadFresh(key string, val *keyedValue) (interface{}, error) {
+	val.refresh.Do(func() {
+		newVal, err := r.refreshFn(key)
+		r.vals.Store(key, &keyedValue{newVal, err, time.Now(), sync.Once{}, 0})
+	})
+
+	val = r.loadOrCreate(key)
+	return val.val, val.err
+}
+
+func (r *KeyedRefresher) loadStale(key string, val *keyedValue) (interface{}, error) {
+	if !atomic.CompareAndSwapUint32(&val.refreshStale, 0, 1) {
+		return val.val, val.err
+	}
+
+	newVal, err := r.refreshFn(key)
+	r.vals.Store(key, &keyedValue{newVal, err, time.Now(), sync.Once{}, 0})
+	return newVal, err
+}
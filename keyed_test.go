@@ -0,0 +1,137 @@
+package refresh
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyedRefresher(t *testing.T) {
+	var (
+		called int32
+		retErr error
+	)
+	r := NewKeyed(time.Hour, func(key string) (interface{}, error) {
+		atomic.AddInt32(&called, 1)
+		return key, retErr
+	})
+
+	for i := 0; i < 10; i++ {
+		c, err := r.Load("a")
+		assert.NoError(t, err)
+		assert.Equal(t, "a", c)
+	}
+
+	retErr = errors.New("error")
+
+	for i := 0; i < 10; i++ {
+		c, err := r.Load("a")
+		assert.NoError(t, err)
+		assert.Equal(t, "a", c)
+	}
+
+	assert.Equal(t, int32(1), called, "cached value should not trigger another call")
+}
+
+func TestKeyedRefresherDistinctKeys(t *testing.T) {
+	var called int32
+	r := NewKeyed(time.Hour, func(key string) (interface{}, error) {
+		atomic.AddInt32(&called, 1)
+		return key, nil
+	})
+
+	a, err := r.Load("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", a)
+
+	b, err := r.Load("b")
+	assert.NoError(t, err)
+	assert.Equal(t, "b", b)
+
+	assert.Equal(t, int32(2), called, "distinct keys must not coalesce")
+}
+
+func TestKeyedRefresherParallel(t *testing.T) {
+	var called int32
+	r := NewKeyed(time.Hour, func(key string) (interface{}, error) {
+		return int(atomic.AddInt32(&called, 1)), nil
+	})
+
+	var (
+		wg   sync.WaitGroup
+		wait = make(chan struct{})
+	)
+	for n := 0; n < runtime.NumCPU(); n++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			<-wait
+
+			c, err := r.Load("key")
+			assert.NoError(t, err)
+			assert.Equal(t, 1, c)
+		}()
+	}
+
+	close(wait)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), called, "concurrent Load for the same key must coalesce")
+}
+
+func TestKeyedRefresherStaleParallel(t *testing.T) {
+	var called int32
+	r := NewKeyed(time.Millisecond, func(key string) (interface{}, error) {
+		time.Sleep(10 * time.Millisecond)
+		return int(atomic.AddInt32(&called, 1)), nil
+	})
+	r.SetStaleWhileRefresh(true)
+
+	c, err := r.Load("key")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, c)
+
+	time.Sleep(10 * time.Millisecond)
+
+	var (
+		wg       sync.WaitGroup
+		wait     = make(chan struct{})
+		sawFresh int32
+	)
+	for n := 0; n < runtime.NumCPU(); n++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			<-wait
+
+			c, err := r.Load("key")
+			assert.NoError(t, err)
+			if assert.Truef(t, c == 1 || c == 2, "c(%d) should be 1 or 2", c) {
+				atomic.AddInt32(&sawFresh, int32(c.(int))-1)
+			}
+		}()
+	}
+
+	close(wait)
+	wg.Wait()
+
+	assert.Equal(t, int32(2), called)
+	assert.Equal(t, int32(1), sawFresh, "sawFresh") // The rest must have seen stale data.
+}
+
+func TestNewKeyedPanicsForInvalidMaxAge(t *testing.T) {
+	dummy := func(string) (interface{}, error) { return nil, nil }
+	assert.PanicsWithValue(t, "refresh: maxAge must be positive duration", func() {
+		NewKeyed(0, dummy)
+	}, "maxAge is 0")
+	assert.PanicsWithValue(t, "refresh: maxAge must be positive duration", func() {
+		NewKeyed(-1, dummy)
+	}, "maxAge is -1")
+}
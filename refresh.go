@@ -3,12 +3,28 @@
 package refresh // import "go.tmthrgd.dev/refresh"
 
 import (
+	"context"
+	"math/rand"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-var testNeedsRefresh = false
+// Clock abstracts time so that it can be replaced in tests. See SetClock and
+// the refreshtest package for a mock implementation.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After waits for d to elapse and then sends the current time on the
+	// returned channel, like time.After.
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
 
 type value struct {
 	val interface{}
@@ -17,6 +33,42 @@ type value struct {
 	when         time.Time
 	refresh      sync.Once // used if !staleWhileRefresh || when.IsZero()
 	refreshStale uint32    // used if staleWhileRefresh && !when.IsZero()
+
+	// done, cancel and refs coordinate callers waiting on an in-flight
+	// refresh started by loadFresh/loadStale. cancel is only called once
+	// the last waiting caller has given up, so one caller's context being
+	// cancelled never aborts the refresh for the others.
+	done   chan struct{}
+	cancel context.CancelFunc
+	refs   int32
+
+	// stale is true if val/err were carried over from an earlier successful
+	// refresh because the most recent refreshFn call failed and
+	// SetStaleIfError is enabled. lastErr is that failed refresh's error,
+	// reported via LoadWithMeta even though it isn't returned by Load.
+	stale   bool
+	lastErr error
+}
+
+// Meta reports how a value returned by LoadWithMeta was produced.
+type Meta struct {
+	// Hit is true if the value was served from cache without this call
+	// itself performing or waiting on a refresh.
+	Hit bool
+
+	// Age is how long ago the returned value was stored by its most recent
+	// refresh. For a value carried over by SetStaleIfError, that is the time
+	// of the failed refresh, not of the refresh that originally fetched it.
+	Age time.Duration
+
+	// Stale is true if the returned value is older than maxAge, for example
+	// because SetStaleWhileRefresh or SetStaleIfError caused a cached value
+	// to be served instead of a fresh one.
+	Stale bool
+
+	// LastError is the error returned by the most recent call to refreshFn,
+	// even if SetStaleIfError caused it to be suppressed by Load.
+	LastError error
 }
 
 // Refresher is an object that will perform an action at most once every
@@ -25,25 +77,57 @@ type Refresher struct {
 	val atomic.Value // *value
 
 	maxAge    time.Duration
-	refreshFn func() (interface{}, error)
+	refreshFn func(ctx context.Context) (interface{}, error)
+	clock     Clock
 
 	staleWhileRefresh bool
+	staleIfError      bool
+
+	backgroundRefresh bool
+	refreshJitter     float64
+
+	bgMu     sync.Mutex
+	bgCancel context.CancelFunc
+	bgDone   chan struct{}
 }
 
 // New returns a Refresher that will call refreshFn at most once every maxAge
 // duration. refreshFn will not be called until Load is called.
 //
-// refreshFn will be called in the same goroutine as Load.
+// refreshFn runs in a dedicated goroutine for each refresh, not the
+// goroutine calling Load; Load merely waits for it to finish. A panic from
+// refreshFn therefore can't be recovered by the caller and will crash the
+// process, same as any other unrecovered panic in a spawned goroutine.
 func New(maxAge time.Duration, refreshFn func() (interface{}, error)) *Refresher {
+	return NewContext(maxAge, func(context.Context) (interface{}, error) {
+		return refreshFn()
+	})
+}
+
+// NewContext is like New, but refreshFn accepts a context that is cancelled
+// once every caller waiting on it has given up, via their own context passed
+// to LoadContext.
+func NewContext(maxAge time.Duration, refreshFn func(ctx context.Context) (interface{}, error)) *Refresher {
 	if maxAge <= 0 {
 		panic("refresh: maxAge must be positive duration")
 	}
 
-	r := &Refresher{atomic.Value{}, maxAge, refreshFn, false}
+	r := &Refresher{
+		maxAge:    maxAge,
+		refreshFn: refreshFn,
+		clock:     realClock{},
+	}
 	r.val.Store(new(value))
 	return r
 }
 
+// SetClock overrides the Clock used by the Refresher, for use in tests; see
+// the refreshtest package for a mock implementation. It defaults to the real
+// wall clock and must be called before Load or Start.
+func (r *Refresher) SetClock(clock Clock) {
+	r.clock = clock
+}
+
 // SetStaleWhileRefresh controls the behaviour of Load when the value is stale.
 // When set to true, only one call to Load will block while any others return
 // stale data. When set to false, all calls to Load will block and only ever
@@ -52,42 +136,258 @@ func (r *Refresher) SetStaleWhileRefresh(v bool) {
 	r.staleWhileRefresh = v
 }
 
+// SetStaleIfError controls the behaviour of Load when refreshFn returns an
+// error but a previously successful value is cached. When set to true, that
+// stale value is returned instead, and the error is suppressed from Load
+// (though still reported as Meta.LastError by LoadWithMeta). When set to
+// false, the error from refreshFn is always returned. It defaults to false.
+func (r *Refresher) SetStaleIfError(v bool) {
+	r.staleIfError = v
+}
+
+// SetBackgroundRefresh controls whether Start runs a background goroutine
+// that proactively calls refreshFn once the value reaches maxAge, shortened
+// by the random amount set with SetRefreshJitter. With no jitter, the
+// refresh starts just as the value expires, not before it, and Load calls
+// arriving while it runs wait for it unless SetStaleWhileRefresh is set. It
+// must be set before Start is called. It defaults to false.
+func (r *Refresher) SetBackgroundRefresh(v bool) {
+	r.backgroundRefresh = v
+}
+
+// SetRefreshJitter sets the fraction, in [0, 1), of maxAge by which the
+// background refresh interval set up by Start is randomly shortened, so that
+// many Refreshers with the same maxAge don't all refresh in lock-step. It
+// defaults to 0.
+func (r *Refresher) SetRefreshJitter(fraction float64) {
+	if fraction < 0 || fraction >= 1 {
+		panic("refresh: jitter fraction must be in [0, 1)")
+	}
+
+	r.refreshJitter = fraction
+}
+
+// Start starts a background goroutine that proactively refreshes the value;
+// it is a no-op unless SetBackgroundRefresh(true) was called, or if already
+// started. The goroutine runs until ctx is cancelled or Stop is called.
+func (r *Refresher) Start(ctx context.Context) {
+	if !r.backgroundRefresh {
+		return
+	}
+
+	r.bgMu.Lock()
+	defer r.bgMu.Unlock()
+
+	if r.bgCancel != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r.bgCancel = cancel
+	r.bgDone = make(chan struct{})
+
+	go r.backgroundLoop(ctx, r.bgDone)
+}
+
+// Stop stops the background goroutine started by Start and waits for it to
+// exit. It is a no-op if no background refresh is running.
+func (r *Refresher) Stop() {
+	r.bgMu.Lock()
+	cancel, done := r.bgCancel, r.bgDone
+	r.bgCancel, r.bgDone = nil, nil
+	r.bgMu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+
+	cancel()
+	<-done
+}
+
+func (r *Refresher) backgroundLoop(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	for {
+		select {
+		case <-r.clock.After(r.nextRefreshDelay()):
+		case <-ctx.Done():
+			return
+		}
+
+		val := r.val.Load().(*value)
+		if _, _, err := r.refreshNow(ctx, val); err != nil && ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// refreshNow forces a refresh of val, reusing the same val.refresh/
+// val.refreshStale single-flight guard that Load would use, so a background
+// refresh and a concurrent Load can never both call refreshFn for the same
+// value. It waits for the refresh to complete before returning, except when
+// ctx is cancelled first or, with SetStaleWhileRefresh, when a Load has
+// already started refreshing val, in which case it returns at once.
+func (r *Refresher) refreshNow(ctx context.Context, val *value) (interface{}, Meta, error) {
+	if r.staleWhileRefresh {
+		return r.loadStale(ctx, val)
+	}
+
+	return r.loadFresh(ctx, val)
+}
+
+// nextRefreshDelay returns how long the background loop should wait before
+// its next refresh, based on the current value's age, maxAge and any
+// configured refresh jitter.
+func (r *Refresher) nextRefreshDelay() time.Duration {
+	interval := r.maxAge
+	if r.refreshJitter > 0 {
+		interval -= time.Duration(rand.Float64() * r.refreshJitter * float64(r.maxAge))
+	}
+
+	val := r.val.Load().(*value)
+	if val.when.IsZero() {
+		return 0
+	}
+
+	if due := val.when.Add(interval).Sub(r.clock.Now()); due > 0 {
+		return due
+	}
+
+	return 0
+}
+
 // Load returns a value that is at most maxAge old. Load will only ever return
-// an error that was returned from refreshFn.
+// an error that was returned from refreshFn, unless SetStaleIfError suppresses
+// it in favour of a stale value.
 //
 // The behaviour of Load when the value is stale can be controlled by
 // SetStaleWhileRefresh. If the value is stale, it will either block all Load
 // calls to call the refreshFn given to New, or only the first Load call.
 func (r *Refresher) Load() (interface{}, error) {
+	return r.LoadContext(context.Background())
+}
+
+// LoadContext is like Load, but if ctx is cancelled while this call is
+// blocked waiting for refreshFn, it returns early with ctx.Err(). The
+// in-flight call to refreshFn is not cancelled by this; it keeps running for
+// any other callers still waiting on it, and is only cancelled once every
+// caller waiting on it has given up.
+func (r *Refresher) LoadContext(ctx context.Context) (interface{}, error) {
+	val, _, err := r.loadWithMeta(ctx)
+	return val, err
+}
+
+// LoadWithMeta is like Load, but also reports Meta describing how the
+// returned value was produced.
+func (r *Refresher) LoadWithMeta() (interface{}, Meta, error) {
+	return r.loadWithMeta(context.Background())
+}
+
+func (r *Refresher) loadWithMeta(ctx context.Context) (interface{}, Meta, error) {
 	val := r.val.Load().(*value)
 	switch {
-	case testNeedsRefresh:
 	case val.when.IsZero(): // first Load
-	case time.Since(val.when) <= r.maxAge:
-		return val.val, val.err
+	case r.clock.Now().Sub(val.when) <= r.maxAge:
+		return val.val, r.metaFrom(val, true), val.err
 	case r.staleWhileRefresh:
-		return r.loadStale(val)
+		return r.loadStale(ctx, val)
 	}
 
-	return r.loadFresh(val)
+	return r.loadFresh(ctx, val)
 }
 
-func (r *Refresher) loadFresh(val *value) (interface{}, error) {
-	val.refresh.Do(func() {
-		newVal, err := r.refreshFn()
-		r.val.Store(&value{newVal, err, time.Now(), sync.Once{}, 0})
-	})
+func (r *Refresher) loadFresh(ctx context.Context, val *value) (interface{}, Meta, error) {
+	val.refresh.Do(func() { r.startRefresh(val) })
+	return r.waitForRefresh(ctx, val)
+}
+
+func (r *Refresher) loadStale(ctx context.Context, val *value) (interface{}, Meta, error) {
+	if !atomic.CompareAndSwapUint32(&val.refreshStale, 0, 1) {
+		return val.val, r.metaFrom(val, true), val.err
+	}
+
+	r.startRefresh(val)
+	return r.waitForRefresh(ctx, val)
+}
+
+// startRefresh kicks off a single call to refreshFn in its own goroutine,
+// storing the result once it completes. It must only be called once per
+// value, guarded by val.refresh or val.refreshStale.
+func (r *Refresher) startRefresh(val *value) {
+	refreshCtx, cancel := context.WithCancel(context.Background())
+	val.cancel = cancel
+	val.done = make(chan struct{})
+
+	go func() {
+		newVal, err := r.refreshFn(refreshCtx)
+		if refreshCtx.Err() != nil {
+			// Every caller waiting on this refresh gave up and cancelled
+			// refreshCtx before refreshFn returned. Its result says nothing
+			// about whether the real value is still good, so it must not be
+			// cached; re-arm val instead, carrying its previous val/err
+			// forward, so the next Load retries a fresh refresh rather than
+			// being stuck serving this abandoned attempt's outcome forever.
+			r.val.Store(&value{
+				val:     val.val,
+				err:     val.err,
+				when:    val.when,
+				stale:   val.stale,
+				lastErr: val.lastErr,
+			})
+			close(val.done)
+			return
+		}
+
+		r.val.Store(r.nextValue(val, newVal, err))
+		close(val.done)
+	}()
+}
+
+// waitForRefresh waits for the refresh started for val to complete, or for
+// ctx to be cancelled. If every caller waiting on val gives up, the refresh
+// itself is cancelled.
+func (r *Refresher) waitForRefresh(ctx context.Context, val *value) (interface{}, Meta, error) {
+	atomic.AddInt32(&val.refs, 1)
+
+	select {
+	case <-val.done:
+		atomic.AddInt32(&val.refs, -1)
+	case <-ctx.Done():
+		if atomic.AddInt32(&val.refs, -1) == 0 {
+			val.cancel()
+		}
+
+		return nil, Meta{}, ctx.Err()
+	}
 
 	val = r.val.Load().(*value)
-	return val.val, val.err
+	return val.val, r.metaFrom(val, false), val.err
 }
 
-func (r *Refresher) loadStale(val *value) (interface{}, error) {
-	if !atomic.CompareAndSwapUint32(&val.refreshStale, 0, 1) {
-		return val.val, val.err
+// nextValue builds the value to store after a refresh attempt, applying
+// SetStaleIfError semantics when the attempt failed.
+func (r *Refresher) nextValue(prev *value, newVal interface{}, err error) *value {
+	if err != nil && r.staleIfError && !prev.when.IsZero() && prev.err == nil {
+		return &value{prev.val, nil, r.clock.Now(), sync.Once{}, 0, nil, nil, 0, true, err}
 	}
 
-	newVal, err := r.refreshFn()
-	r.val.Store(&value{newVal, err, time.Now(), sync.Once{}, 0})
-	return newVal, err
+	return &value{newVal, err, r.clock.Now(), sync.Once{}, 0, nil, nil, 0, false, err}
+}
+
+// metaFrom builds the Meta reported alongside val, where hit indicates
+// whether this Load returned without itself performing or waiting on a
+// refresh.
+func (r *Refresher) metaFrom(val *value, hit bool) Meta {
+	var age time.Duration
+	if !val.when.IsZero() {
+		age = r.clock.Now().Sub(val.when)
+	}
+
+	return Meta{
+		Hit:       hit,
+		Age:       age,
+		Stale:     val.stale || age > r.maxAge,
+		LastError: val.lastErr,
+	}
 }
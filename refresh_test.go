@@ -1,6 +1,7 @@
 package refresh
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net/http"
@@ -11,6 +12,8 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"go.tmthrgd.dev/refresh/refreshtest"
 )
 
 func expensiveCall() ([]byte, error) { return []byte("ok"), nil }
@@ -37,7 +40,7 @@ func ExampleNew_http() {
 }
 
 func TestRefresher(t *testing.T) {
-	defer func() { testNeedsRefresh = false }()
+	clock := refreshtest.NewMock(time.Unix(0, 0))
 
 	var (
 		called int
@@ -47,10 +50,13 @@ func TestRefresher(t *testing.T) {
 		called++
 		return called, retErr
 	})
+	r.SetClock(clock)
 
 	for n := 1; n <= 2; n++ {
 		for i := 0; i < 10; i++ {
-			testNeedsRefresh = n > 1 && i == 0
+			if n > 1 && i == 0 {
+				clock.Add(time.Hour + time.Second) // force the value to go stale
+			}
 
 			c, err := r.Load()
 			assert.NoError(t, err)
@@ -67,7 +73,9 @@ func TestRefresher(t *testing.T) {
 	}
 
 	for i := 0; i < 10; i++ {
-		testNeedsRefresh = i == 0
+		if i == 0 {
+			clock.Add(time.Hour + time.Second) // force the value to go stale
+		}
 
 		c, err := r.Load()
 		assert.EqualError(t, err, retErr.Error())
@@ -196,6 +204,272 @@ func TestRefresherStaleParallelFirstLoad(t *testing.T) {
 	assert.Equal(t, int32(1), called)
 }
 
+func TestRefresherLoadContextCancellation(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	var called int32
+	r := NewContext(time.Hour, func(ctx context.Context) (interface{}, error) {
+		close(started)
+		<-release
+		return int(atomic.AddInt32(&called, 1)), nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		c, err := r.LoadContext(ctx)
+		assert.Equal(t, context.Canceled, err)
+		assert.Nil(t, c)
+	}()
+
+	<-started // wait for the refresh to start before the second caller joins it
+
+	joined := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		close(joined)
+
+		c, err := r.Load()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, c)
+	}()
+
+	<-joined
+	time.Sleep(10 * time.Millisecond) // give the joining Load a moment to start waiting
+	cancel()
+	time.Sleep(20 * time.Millisecond) // let the cancelled caller return first
+	close(release)
+
+	wg.Wait()
+
+	assert.Equal(t, int32(1), called, "cancelling one caller must not abort the refresh for another")
+}
+
+func TestRefresherAbandonedRefreshDoesNotPoisonCache(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	var called int32
+	r := NewContext(time.Hour, func(ctx context.Context) (interface{}, error) {
+		n := atomic.AddInt32(&called, 1)
+		if n == 1 {
+			close(started)
+			<-release
+			return nil, ctx.Err()
+		}
+
+		return int(n), nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	loadDone := make(chan struct{})
+	go func() {
+		defer close(loadDone)
+		_, err := r.LoadContext(ctx)
+		assert.Equal(t, context.Canceled, err)
+	}()
+
+	<-started
+	cancel()   // ctx is the only caller waiting, so its own refresh is abandoned
+	<-loadDone // the cancelled LoadContext has already returned
+
+	close(release)                    // let the abandoned refreshFn call finally return
+	time.Sleep(10 * time.Millisecond) // give startRefresh's goroutine time to re-arm val
+
+	c, err := r.Load()
+	assert.NoError(t, err, "an abandoned refresh must not poison the cache with its cancellation error")
+	assert.Equal(t, 2, c, "Load must retry its own refresh instead of reusing the abandoned attempt's result")
+}
+
+func TestRefresherStopDoesNotPoisonCacheWithInFlightRefresh(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	var called int32
+	r := New(5*time.Millisecond, func() (interface{}, error) {
+		n := atomic.AddInt32(&called, 1)
+		if n == 2 {
+			close(started)
+			<-release
+		}
+
+		return int(n), nil
+	})
+	r.SetBackgroundRefresh(true)
+
+	c, err := r.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, c)
+
+	r.Start(context.Background())
+
+	<-started // the background loop has started refreshing the now-stale value
+	r.Stop()  // Stop must return without waiting for that refreshFn call to finish
+	close(release)
+
+	time.Sleep(10 * time.Millisecond) // give the abandoned refresh's goroutine time to re-arm val
+
+	c, err = r.Load()
+	assert.NoError(t, err, "Stop racing an in-flight background refresh must not poison the cache with a cancellation error")
+}
+
+func TestRefresherBackgroundRefresh(t *testing.T) {
+	var called int32
+	r := New(20*time.Millisecond, func() (interface{}, error) {
+		return int(atomic.AddInt32(&called, 1)), nil
+	})
+	r.SetBackgroundRefresh(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.Start(ctx)
+	defer r.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	c, err := r.Load()
+	assert.NoError(t, err)
+	assert.Greater(t, c.(int), 1, "background refresh should have run without Load blocking on it")
+}
+
+func TestRefresherBackgroundRefreshNoDoubleFire(t *testing.T) {
+	var called int32
+	r := New(5*time.Millisecond, func() (interface{}, error) {
+		time.Sleep(time.Millisecond)
+		return int(atomic.AddInt32(&called, 1)), nil
+	})
+	r.SetBackgroundRefresh(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.Start(ctx)
+	defer r.Stop()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				r.Load()
+			}
+		}()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	cancel()
+
+	// With a 5ms refresh interval, ~100ms of concurrent Load calls racing the
+	// background timer should still only trigger on the order of 100/5 = 20
+	// refreshes. If Load and the background loop raced independently to
+	// refreshFn instead of sharing the same single-flight guard, this count
+	// would run far higher.
+	assert.Less(t, int(atomic.LoadInt32(&called)), 100, "refreshFn must not be triggered by both Load and the background loop for the same interval")
+}
+
+func TestRefresherBackgroundRefreshWithMockClock(t *testing.T) {
+	clock := refreshtest.NewMock(time.Unix(0, 0))
+
+	var called int32
+	r := New(time.Hour, func() (interface{}, error) {
+		return int(atomic.AddInt32(&called, 1)), nil
+	})
+	r.SetClock(clock)
+	r.SetBackgroundRefresh(true)
+
+	c, err := r.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.Start(ctx)
+	defer r.Stop()
+
+	clock.Add(time.Hour + time.Second)
+
+	for i := 0; i < 100 && atomic.LoadInt32(&called) < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&called), "advancing the mock clock should trigger the background refresh")
+}
+
+func TestRefresherStartNoopWithoutBackgroundRefresh(t *testing.T) {
+	var called int32
+	r := New(time.Millisecond, func() (interface{}, error) {
+		return int(atomic.AddInt32(&called, 1)), nil
+	})
+
+	r.Start(context.Background())
+	defer r.Stop()
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&called), "Start must be a no-op unless SetBackgroundRefresh(true)")
+}
+
+func TestRefresherStaleIfError(t *testing.T) {
+	var called int32
+	retErr := errors.New("upstream down")
+	r := New(time.Millisecond, func() (interface{}, error) {
+		n := atomic.AddInt32(&called, 1)
+		if n > 1 {
+			return nil, retErr
+		}
+
+		return int(n), nil
+	})
+	r.SetStaleIfError(true)
+
+	c, err := r.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, c)
+
+	time.Sleep(10 * time.Millisecond)
+
+	c, err = r.Load()
+	assert.NoError(t, err, "a failed refresh should serve the last good value")
+	assert.Equal(t, 1, c)
+
+	_, meta, err := r.LoadWithMeta()
+	assert.NoError(t, err)
+	assert.EqualError(t, meta.LastError, retErr.Error())
+	assert.True(t, meta.Stale)
+}
+
+func TestRefresherLoadWithMeta(t *testing.T) {
+	var called int32
+	r := New(time.Hour, func() (interface{}, error) {
+		return int(atomic.AddInt32(&called, 1)), nil
+	})
+
+	c, meta, err := r.LoadWithMeta()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, c)
+	assert.False(t, meta.Hit, "the first Load must perform a refresh")
+	assert.False(t, meta.Stale)
+
+	c, meta, err = r.LoadWithMeta()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, c)
+	assert.True(t, meta.Hit, "a cached value should be reported as a hit")
+}
+
 func TestNewPanicsForInvalidMaxAge(t *testing.T) {
 	dummy := func() (interface{}, error) { return nil, nil }
 	assert.PanicsWithValue(t, "refresh: maxAge must be positive duration", func() {
@@ -0,0 +1,79 @@
+// Package refreshtest provides a mock refresh.Clock for use in tests.
+package refreshtest
+
+import (
+	"sync"
+	"time"
+)
+
+type waiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+// Mock is a refresh.Clock implementation that only advances when Add or Set
+// is called, letting tests deterministically exercise cache expiration,
+// stale-while-refresh transitions and background refresh timing without
+// time.Sleep.
+type Mock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*waiter
+}
+
+// NewMock returns a Mock clock whose current time is now.
+func NewMock(now time.Time) *Mock {
+	return &Mock{now: now}
+}
+
+// Now returns the clock's current time.
+func (m *Mock) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+// Set sets the clock's current time to t, firing any After channels whose
+// deadline has since passed.
+func (m *Mock) Set(t time.Time) {
+	m.mu.Lock()
+	m.now = t
+	m.fireLocked()
+	m.mu.Unlock()
+}
+
+// Add advances the clock's current time by d, firing any After channels
+// whose deadline has since passed.
+func (m *Mock) Add(d time.Duration) {
+	m.Set(m.Now().Add(d))
+}
+
+// After returns a channel that receives the clock's current time once it has
+// advanced by at least d, via Add or Set.
+func (m *Mock) After(d time.Duration) <-chan time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w := &waiter{at: m.now.Add(d), c: make(chan time.Time, 1)}
+	if !w.at.After(m.now) {
+		w.c <- m.now
+		return w.c
+	}
+
+	m.waiters = append(m.waiters, w)
+	return w.c
+}
+
+// fireLocked must be called with m.mu held.
+func (m *Mock) fireLocked() {
+	pending := m.waiters[:0]
+	for _, w := range m.waiters {
+		if !m.now.Before(w.at) {
+			w.c <- m.now
+		} else {
+			pending = append(pending, w)
+		}
+	}
+
+	m.waiters = pending
+}
@@ -0,0 +1,50 @@
+package refreshtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMockNowAdvancesExplicitly(t *testing.T) {
+	start := time.Unix(0, 0)
+	m := NewMock(start)
+	assert.Equal(t, start, m.Now())
+
+	m.Add(time.Hour)
+	assert.Equal(t, start.Add(time.Hour), m.Now())
+
+	later := start.Add(24 * time.Hour)
+	m.Set(later)
+	assert.Equal(t, later, m.Now())
+}
+
+func TestMockAfterFiresOnAdd(t *testing.T) {
+	m := NewMock(time.Unix(0, 0))
+
+	c := m.After(time.Minute)
+	select {
+	case <-c:
+		t.Fatal("After fired before the clock advanced")
+	default:
+	}
+
+	m.Add(time.Minute)
+
+	select {
+	case <-c:
+	case <-time.After(time.Second):
+		t.Fatal("After did not fire once the clock advanced past the deadline")
+	}
+}
+
+func TestMockAfterFiresImmediatelyForPastDeadline(t *testing.T) {
+	m := NewMock(time.Unix(0, 0))
+
+	select {
+	case <-m.After(0):
+	case <-time.After(time.Second):
+		t.Fatal("After(0) should fire immediately")
+	}
+}